@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	flag "github.com/docker/docker/pkg/mflag"
 	"github.com/fsouza/go-dockerclient"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -24,12 +26,26 @@ var (
 	GITCOMMIT string
 )
 
+// imgNiceName/imgTag are the temporary repo/tag dlgrab tags the inspected
+// image under before pushing it at the shim, shared between dockerMain
+// (which does the tagging) and writeImageBundle (which records them in
+// the repositories file of a --all-layers export).
+const (
+	imgNiceName = "dlgrab_tmp"
+	imgTag      = "latest"
+)
+
 func main() {
 	var outDir string
 	var doDebug bool
 	var doHelp bool
 	var doTagRemove bool
 	var regFormat bool
+	var doV2 bool
+	var doAllLayers bool
+	var doOCILayout bool
+	var platformStr string
+	var fromRegistry string
 
 	helpFd := os.Stderr
 	flag.Usage = func() {
@@ -45,6 +61,11 @@ func main() {
 	flag.BoolVar(&doTagRemove, []string{"-clean"}, false, "Remove the temporary tag after use\nWARNING: can trigger layer deletion if run on a layer with no children or other references")
 	flag.BoolVar(&doDebug, []string{"-debug"}, false, "Set log level to debug")
 	flag.BoolVar(&regFormat, []string{"-registry-format"}, false, "Output in the format a registry would use, rather than for an image export")
+	flag.BoolVar(&doV2, []string{"-v2", "-oci"}, false, "Speak the registry v2/schema2 protocol instead of v1, capturing gzipped blobs named by digest plus a schema2 manifest")
+	flag.BoolVar(&doAllLayers, []string{"-all-layers", "-full-image"}, false, "Capture every layer in the image's parent chain, not just the top one, and emit a docker save-compatible bundle (manifest.json + repositories)")
+	flag.BoolVar(&doOCILayout, []string{"-oci-layout"}, false, "Write an OCI Image Layout (oci-layout, index.json, blobs/sha256/...) instead of --registry-format's flat files")
+	flag.StringVar(&platformStr, []string{"-platform"}, "", "os/arch[/variant] to select when LAYER resolves to a manifest-list-backed image")
+	flag.StringVar(&fromRegistry, []string{"-from-registry"}, "", "Fetch LAYER directly from the v2 registry at this URL instead of intercepting a docker daemon push; bypasses the docker daemon and shim entirely")
 	flag.Parse()
 
 	if len(flag.Args()) != 1 {
@@ -61,6 +82,20 @@ func main() {
 		flag.Usage()
 		return
 	}
+
+	ref, err := parseReference(imgId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+	var platform *platformSpec
+	if platformStr != "" {
+		platform, err = parsePlatform(platformStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(2)
+		}
+	}
 	logger.Level = INFO
 	if doDebug {
 		logger.Level = DEBUG
@@ -76,6 +111,15 @@ func main() {
 		os.Exit(1)
 	}()
 
+	if fromRegistry != "" {
+		if err := pullFromRegistry(fromRegistry, ref, platform, outDir, regFormat, doAllLayers, doOCILayout); err != nil {
+			logger.Error("%s", err)
+			os.Exit(1)
+		}
+		logger.Info("Export complete")
+		return
+	}
+
 	endpoint := os.Getenv("DOCKER_HOST")
 	if endpoint == "" {
 		endpoint = "unix:///var/run/docker.sock"
@@ -87,7 +131,7 @@ func main() {
 	}
 
 	layerLock.Lock()
-	imgJson, err := client.InspectImage(imgId)
+	imgJson, err := client.InspectImage(ref.Lookup())
 	if err != nil {
 		logger.Error("%s", err.Error())
 		os.Exit(1)
@@ -98,17 +142,73 @@ func main() {
 	}
 	layerLock.Unlock()
 
-	logger.Info("Layer folder will be dumped into %s", outDir)
-	layerLock.Lock()
-	layerOutDir := filepath.Join(outDir, layerId)
-	layerLock.Unlock()
-	err = os.Mkdir(layerOutDir, 0755)
-	if err != nil {
-		logger.Error("%s", err.Error())
+	if ref.Digest != "" && !hasRepoDigest(imgJson.RepoDigests, ref.Name, ref.Digest) {
+		logger.Error("reference %s: tag and digest disagree, %s does not resolve to %s locally", imgId, ref.Lookup(), ref.Digest)
+		os.Exit(2)
+	}
+
+	if platform != nil && (imgJson.OS != platform.OS || imgJson.Architecture != platform.Arch) {
+		logger.Error("image %s resolved to %s/%s locally, not requested platform %s; dlgrab can only pick among what the daemon already has, not pull a different platform from a manifest list", ref.Lookup(), imgJson.OS, imgJson.Architecture, platform)
 		os.Exit(1)
 	}
-	if !regFormat {
-		ioutil.WriteFile(filepath.Join(layerOutDir, "VERSION"), []byte("1.0"), 0644)
+
+	// Prefer a stable content digest for the output directory name over
+	// the locally-chosen layer id, so the same image produces the same
+	// path across machines/runs.
+	outputId := layerId
+	if resolvedDigest := ref.Digest; resolvedDigest != "" || ref.Tag != "" {
+		if resolvedDigest == "" {
+			resolvedDigest = repoDigestFor(imgJson.RepoDigests, ref.Name)
+		}
+		if resolvedDigest != "" {
+			outputId = strings.Replace(resolvedDigest, ":", "_", 1)
+		}
+	}
+
+	// --oci-layout needs the full parent chain too, not just the top layer:
+	// the shim's ociLayout write path (sink.go's WriteLayer) content-addresses
+	// every layer the daemon pushes regardless of this flag, so layerChain
+	// has to list all of them or writeOCILayout's manifest/rootfs will
+	// silently omit everything but the top layer.
+	var layerChain []string
+	if doAllLayers || doOCILayout {
+		hist, err := client.ImageHistory(layerId)
+		if err != nil {
+			logger.Error("%s", err.Error())
+			os.Exit(1)
+		}
+		for _, h := range hist {
+			if h.ID == "<missing>" {
+				logger.Error("image %s has an ancestor layer docker doesn't have locally (reported as \"<missing>\"); --all-layers/--oci-layout need every layer to be a real, locally-tracked image id, which usually means the image was pulled rather than built here", ref.Lookup())
+				os.Exit(1)
+			}
+			layerChain = append(layerChain, h.ID)
+		}
+		logger.Info("Image has %d layers in its parent chain", len(layerChain))
+	} else {
+		layerChain = []string{layerId}
+	}
+
+	logger.Info("Layer folder will be dumped into %s", outDir)
+	if !doOCILayout && !doV2 {
+		// Under --v2 this pre-creation would just leave an empty
+		// leftover directory named after the docker layer id: a v2
+		// push never writes through the legacy /v1/images/<id>/...
+		// path, and any real per-layer directories it does need get
+		// created from the pushed manifest instead (CaptureV2Manifest
+		// in sink.go), once --all-layers/--oci-layout know which
+		// digest belongs to which layer.
+		layerLock.Lock()
+		layerOutDir := filepath.Join(outDir, layerId)
+		layerLock.Unlock()
+		err = os.Mkdir(layerOutDir, 0755)
+		if err != nil {
+			logger.Error("%s", err.Error())
+			os.Exit(1)
+		}
+		if !regFormat {
+			ioutil.WriteFile(filepath.Join(layerOutDir, "VERSION"), []byte("1.0"), 0644)
+		}
 	}
 
 	logger.Debug("Attempting to probe for available port")
@@ -122,15 +222,20 @@ func main() {
 	sock.Close()
 
 	logger.Debug("Starting shim registry on %s", listenOn)
+	handler := NewHandler(outDir, regFormat, doV2, doAllLayers, doOCILayout)
 	go (func() {
-		if err := http.ListenAndServe(listenOn, NewHandler(outDir, regFormat)); err != nil {
+		if err := http.ListenAndServe(listenOn, handler); err != nil {
 			logger.Error("%s", err.Error())
 			os.Exit(1)
 		}
 	})()
 
 	sleeps := []int{1, 5, 10, 100, 200, 500, 1000, 2000}
-	pingUrl := "http://" + listenOn + "/v1/_ping"
+	pingPath := "/v1/_ping"
+	if doV2 {
+		pingPath = "/v2/"
+	}
+	pingUrl := "http://" + listenOn + pingPath
 	apiIsUp := false
 	logger.Debug("Waiting for shim registry to start by checking %s", pingUrl)
 	for _, ms := range sleeps {
@@ -156,13 +261,98 @@ func main() {
 		os.Exit(1)
 	}
 
+	// A v2 push identifies layers by digest, never by docker layer id, so
+	// the chain ImageHistory gave us above doesn't line up with what the
+	// shim actually captured; CaptureV2Manifest (sink.go) derived the real
+	// one once the manifest came in, and that's what --all-layers/
+	// --oci-layout need to use from here on.
+	if doV2 && (doAllLayers || doOCILayout) {
+		v2Chain := handler.sink.CapturedChain()
+		if v2Chain == nil {
+			logger.Error("v2 push completed without a manifest naming any layers")
+			os.Exit(1)
+		}
+		layerChain = v2Chain
+	}
+
+	if !doOCILayout && !doAllLayers && !doV2 && outputId != layerId {
+		layerLock.Lock()
+		oldDir := filepath.Join(outDir, layerId)
+		layerLock.Unlock()
+		if err := os.Rename(oldDir, filepath.Join(outDir, outputId)); err != nil {
+			logger.Error("%s", err)
+			os.Exit(1)
+		}
+		logger.Info("Layer folder renamed to stable digest %s", outputId)
+	}
+
+	if doAllLayers {
+		if err := writeImageBundle(outDir, layerChain); err != nil {
+			logger.Error("%s", err)
+			os.Exit(1)
+		}
+	}
+
+	if doOCILayout {
+		if err := writeOCILayout(outDir, handler.sink, imgJson.Architecture, imgJson.OS, imgJson.Config, layerChain); err != nil {
+			logger.Error("%s", err)
+			os.Exit(1)
+		}
+	}
+
 	logger.Info("Export complete")
 }
 
+// writeImageBundle emits the top-level manifest.json and repositories files
+// that accompany a --all-layers export, turning the per-layer directories
+// the shim just captured into a `docker load`-able bundle. layerChain is
+// ordered newest-first, as returned by ImageHistory.
+func writeImageBundle(outDir string, layerChain []string) error {
+	if len(layerChain) == 0 {
+		return fmt.Errorf("no layers were captured")
+	}
+	topId := layerChain[0]
+
+	layers := make([]string, len(layerChain))
+	for i, id := range layerChain {
+		layers[len(layerChain)-1-i] = id + "/layer.tar"
+	}
+
+	manifest := []map[string]interface{}{
+		{
+			"Config":   topId + ".json",
+			"RepoTags": []string{imgNiceName + ":" + imgTag},
+			"Layers":   layers,
+		},
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "manifest.json"), manifestBytes, 0644); err != nil {
+		return err
+	}
+
+	topJson, err := ioutil.ReadFile(filepath.Join(outDir, topId, "json"))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, topId+".json"), topJson, 0644); err != nil {
+		return err
+	}
+
+	repositories := map[string]map[string]string{
+		imgNiceName: {imgTag: topId},
+	}
+	repoBytes, err := json.MarshalIndent(repositories, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(outDir, "repositories"), repoBytes, 0644)
+}
+
 func dockerMain(client *docker.Client, regUrl string, removeTag bool) (err error) {
-	imgNiceName := "dlgrab_tmp"
 	imgName := regUrl + "/" + "dlgrab_push_staging_tmp"
-	imgTag := "latest"
 
 	logger.Debug("Tagging image into temporary repo")
 	tagOpts := docker.TagImageOptions{
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type LogLevel int
+
+const (
+	DEBUG LogLevel = iota
+	INFO
+	ERROR
+)
+
+// Logger is a tiny leveled logger that writes to stderr. It exists so the
+// rest of dlgrab doesn't need to care whether --debug was passed.
+type Logger struct {
+	Level LogLevel
+}
+
+func (l *Logger) log(level LogLevel, tag, format string, args ...interface{}) {
+	if level < l.Level {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "["+tag+"] "+format+"\n", args...)
+}
+
+func (l *Logger) Debug(format string, args ...interface{}) {
+	l.log(DEBUG, "debug", format, args...)
+}
+
+func (l *Logger) Info(format string, args ...interface{}) {
+	l.log(INFO, "info", format, args...)
+}
+
+func (l *Logger) Error(format string, args ...interface{}) {
+	l.log(ERROR, "error", format, args...)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	ociMediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ociImageConfig struct {
+	Architecture string         `json:"architecture"`
+	OS           string         `json:"os"`
+	Config       *docker.Config `json:"config,omitempty"`
+	RootFS       ociRootFS      `json:"rootfs"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// writeOCILayout assembles the blobs already content-addressed into a
+// layerSink (see sink.go's writeContentAddressedBlob) into an OCI Image
+// Layout (https://github.com/opencontainers/image-spec/blob/main/image-layout.md)
+// under outDir, so the result can be read directly by tools like
+// `skopeo copy oci:...` or `podman load`. layerChain lists the captured
+// layer ids newest-first, as returned by ImageHistory (or, for a
+// --from-registry pull, synthesized from the fetched manifest). sink is
+// shared by both the push-intercepting shim and the pull path; the image
+// config is passed in as plain fields rather than a *docker.Image so
+// either caller can supply it regardless of where it came from.
+func writeOCILayout(outDir string, sink *layerSink, architecture, os string, imgConfig *docker.Config, layerChain []string) error {
+	config := ociImageConfig{
+		Architecture: architecture,
+		OS:           os,
+		Config:       imgConfig,
+		RootFS:       ociRootFS{Type: "layers"},
+	}
+
+	var layers []ociDescriptor
+	for i := len(layerChain) - 1; i >= 0; i-- {
+		info, ok := sink.LayerBlob(layerChain[i])
+		if !ok {
+			return fmt.Errorf("no layer blob captured for %s", layerChain[i])
+		}
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, info.DiffID)
+		layers = append(layers, ociDescriptor{
+			MediaType: ociMediaTypeLayerGzip,
+			Digest:    info.Digest,
+			Size:      info.Size,
+		})
+	}
+
+	configDigest, configSize, err := writeOCIJSONBlob(sink, config)
+	if err != nil {
+		return err
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeManifest,
+		Config: ociDescriptor{
+			MediaType: ociMediaTypeConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+	manifestDigest, manifestSize, err := writeOCIJSONBlob(sink, manifest)
+	if err != nil {
+		return err
+	}
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		Manifests: []ociDescriptor{
+			{
+				MediaType: ociMediaTypeManifest,
+				Digest:    manifestDigest,
+				Size:      manifestSize,
+			},
+		},
+	}
+	indexBytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "index.json"), indexBytes, 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(outDir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+func writeOCIJSONBlob(sink *layerSink, v interface{}) (digest string, size int64, err error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return "", 0, err
+	}
+	return sink.writeContentAddressedBlob(bytes.NewReader(body))
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	mediaTypeManifestList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeManifestSchema2 = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCIIndex        = "application/vnd.oci.image.index.v1+json"
+)
+
+// registryClient speaks just enough of the registry v2 client protocol for
+// --from-registry: resolving a manifest and fetching blobs directly from a
+// registry, handling the Bearer token exchange a registry's 401 challenge
+// asks for along the way. It deliberately knows nothing about docker or the
+// shim; anything it fetches is handed to a layerSink, same as a push the
+// shim intercepted.
+type registryClient struct {
+	base  string
+	http  *http.Client
+	token string
+}
+
+func newRegistryClient(base string) *registryClient {
+	return &registryClient{base: strings.TrimRight(base, "/"), http: &http.Client{}}
+}
+
+// get issues an authenticated GET, transparently completing the
+// Www-Authenticate: Bearer challenge once and retrying if the registry asks
+// for one.
+func (c *registryClient) get(path, accept string) (*http.Response, error) {
+	resp, err := c.doGet(path, accept)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("Www-Authenticate")
+	resp.Body.Close()
+	if err := c.authenticate(challenge); err != nil {
+		return nil, err
+	}
+	return c.doGet(path, accept)
+}
+
+func (c *registryClient) doGet(path, accept string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+// authenticate satisfies a "Bearer realm=...,service=...,scope=..."
+// challenge by fetching a token from realm and caching it for subsequent
+// requests.
+func (c *registryClient) authenticate(challenge string) error {
+	realm, service, scope, err := parseBearerChallenge(challenge)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return fmt.Errorf("invalid auth realm %q: %s", realm, err)
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := c.http.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request to %s failed: %s", u, resp.Status)
+	}
+
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return fmt.Errorf("decoding token response from %s: %s", u, err)
+	}
+	c.token = tok.Token
+	if c.token == "" {
+		c.token = tok.AccessToken
+	}
+	if c.token == "" {
+		return fmt.Errorf("token response from %s had no token", u)
+	}
+	return nil
+}
+
+// parseBearerChallenge pulls realm/service/scope out of a
+// `Bearer realm="...",service="...",scope="..."` Www-Authenticate header.
+func parseBearerChallenge(challenge string) (realm, service, scope string, err error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", "", "", fmt.Errorf("unsupported auth challenge %q, dlgrab only speaks Bearer", challenge)
+	}
+	for _, field := range strings.Split(challenge[len("Bearer "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.Trim(kv[1], `"`)
+		switch kv[0] {
+		case "realm":
+			realm = v
+		case "service":
+			service = v
+		case "scope":
+			scope = v
+		}
+	}
+	if realm == "" {
+		return "", "", "", fmt.Errorf("auth challenge %q had no realm", challenge)
+	}
+	return realm, service, scope, nil
+}
+
+// pullFromRegistry implements --from-registry: it resolves ref against the
+// v2 registry at registryURL, fetches its manifest (descending through a
+// manifest list if the reference resolves to one) and every layer blob it
+// names, and writes them into outDir through a layerSink in the same
+// on-disk layout dockerMain's shim produces, without ever touching a local
+// docker daemon.
+func pullFromRegistry(registryURL string, ref *imageReference, platform *platformSpec, outDir string, regFormat, allLayers, ociLayout bool) error {
+	c := newRegistryClient(registryURL)
+
+	lookupRef := ref.Tag
+	if lookupRef == "" {
+		lookupRef = ref.Digest
+	}
+	if lookupRef == "" {
+		lookupRef = "latest"
+	}
+
+	accept := strings.Join([]string{mediaTypeManifestSchema2, ociMediaTypeManifest, mediaTypeManifestList, mediaTypeOCIIndex}, ", ")
+	manifestBody, manifestMediaType, err := fetchManifest(c, ref.Name, lookupRef, accept)
+	if err != nil {
+		return err
+	}
+
+	// ref.Digest names what the reference itself resolves to, which for a
+	// multi-platform image is the manifest list, so it is checked against
+	// that body before selectPlatform descends to a per-platform manifest.
+	if ref.Digest != "" {
+		sum := sha256.Sum256(manifestBody)
+		if resolved := "sha256:" + hex.EncodeToString(sum[:]); resolved != ref.Digest {
+			return fmt.Errorf("reference %s: tag and digest disagree, %s resolved to manifest digest %s", ref.Lookup(), ref.Lookup(), resolved)
+		}
+	}
+
+	if manifestMediaType == mediaTypeManifestList || manifestMediaType == mediaTypeOCIIndex {
+		digest, err := selectPlatform(manifestBody, platform)
+		if err != nil {
+			return err
+		}
+		manifestBody, manifestMediaType, err = fetchManifest(c, ref.Name, digest, accept)
+		if err != nil {
+			return err
+		}
+	} else if platform != nil {
+		return fmt.Errorf("reference %s resolved directly to a single-platform manifest; --platform %s has nothing to select among", ref.Lookup(), platform)
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBody, &manifest); err != nil {
+		return fmt.Errorf("decoding manifest: %s", err)
+	}
+	if len(manifest.Layers) == 0 {
+		return fmt.Errorf("manifest for %s has no layers", ref.Lookup())
+	}
+
+	// The manifest's own digest, not the config blob's, is what the daemon
+	// path (ref.Digest / repoDigestFor in dlgrab.go) and the rest of the
+	// registry ecosystem mean by "the image digest" — compute it the same
+	// way registry.go's push-side handleV2PutManifest does, so an image
+	// captured via --from-registry lands under the same stable directory
+	// name as the same image captured through the shim.
+	sum := sha256.Sum256(manifestBody)
+	manifestDigest := "sha256:" + hex.EncodeToString(sum[:])
+
+	configFile, err := fetchVerifiedBlob(c, outDir, ref.Name, manifest.Config.Digest)
+	if err != nil {
+		return fmt.Errorf("fetching config blob %s: %s", manifest.Config.Digest, err)
+	}
+	configBody, err := ioutil.ReadAll(configFile)
+	configFile.Close()
+	os.Remove(configFile.Name())
+	if err != nil {
+		return fmt.Errorf("reading config blob %s: %s", manifest.Config.Digest, err)
+	}
+	var cfg ociImageConfig
+	if err := json.Unmarshal(configBody, &cfg); err != nil {
+		return fmt.Errorf("decoding config blob %s: %s", manifest.Config.Digest, err)
+	}
+
+	// Layers are listed base-first in a schema2/OCI manifest; layerChain is
+	// kept newest-first everywhere else in dlgrab (to match ImageHistory),
+	// so build it in reverse. The synthetic id for each layer is its digest
+	// with the colon swapped for an underscore, since there's no daemon
+	// here to hand us a layer id.
+	layerChain := make([]string, len(manifest.Layers))
+	for i, l := range manifest.Layers {
+		layerChain[len(manifest.Layers)-1-i] = strings.Replace(l.Digest, ":", "_", 1)
+	}
+	topId := layerChain[0]
+
+	layerLock.Lock()
+	layerId = topId
+	layerLock.Unlock()
+
+	sink := newLayerSink(outDir, regFormat, allLayers, ociLayout)
+
+	if err := sink.WriteConfig(topId, bytes.NewReader(configBody)); err != nil {
+		return fmt.Errorf("writing config: %s", err)
+	}
+	for i, l := range manifest.Layers {
+		synthId := layerChain[len(manifest.Layers)-1-i]
+		blobFile, err := fetchVerifiedBlob(c, outDir, ref.Name, l.Digest)
+		if err != nil {
+			return fmt.Errorf("fetching layer blob %s: %s", l.Digest, err)
+		}
+		err = sink.WriteLayer(synthId, blobFile)
+		blobFile.Close()
+		os.Remove(blobFile.Name())
+		if err != nil {
+			return fmt.Errorf("writing layer %s: %s", l.Digest, err)
+		}
+	}
+
+	if !ociLayout && !allLayers {
+		resolvedDigest := ref.Digest
+		if resolvedDigest == "" {
+			resolvedDigest = manifestDigest
+		}
+		outputId := strings.Replace(resolvedDigest, ":", "_", 1)
+		if outputId != topId {
+			if err := renameLayerDir(outDir, topId, outputId); err != nil {
+				return err
+			}
+			logger.Info("Layer folder renamed to stable digest %s", outputId)
+		}
+	}
+
+	if allLayers {
+		if err := writeImageBundle(outDir, layerChain); err != nil {
+			return err
+		}
+	}
+	if ociLayout {
+		if err := writeOCILayout(outDir, sink, cfg.Architecture, cfg.OS, cfg.Config, layerChain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renameLayerDir moves outDir/from to outDir/to, used to swap the
+// digest-derived synthetic top layer id for the stable content digest
+// dlgrab names single-layer exports after.
+func renameLayerDir(outDir, from, to string) error {
+	return os.Rename(filepath.Join(outDir, from), filepath.Join(outDir, to))
+}
+
+// fetchManifest retrieves a manifest by tag or digest, returning its raw
+// body and the Content-Type the registry served it as.
+func fetchManifest(c *registryClient, name, ref, accept string) ([]byte, string, error) {
+	resp, err := c.get(fmt.Sprintf("/v2/%s/manifests/%s", name, ref), accept)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetching manifest %s/%s: %s", name, ref, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	return body, mediaType, nil
+}
+
+// fetchVerifiedBlob streams a blob to a scratch file under outDir while
+// hashing it, the same pattern writeContentAddressedBlob uses for blobs
+// the v2 shim receives, and refuses to hand anything back if the computed
+// digest disagrees with digest — the one the manifest said this blob
+// should be. Guards against a misbehaving or MITM'd registry handing back
+// arbitrary bytes for a blob request and dlgrab storing them under an
+// identity they don't actually match. Callers are responsible for closing
+// and removing the returned file once they're done reading it.
+func fetchVerifiedBlob(c *registryClient, outDir, name, digest string) (*os.File, error) {
+	resp, err := fetchBlobStream(c, name, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := ioutil.TempFile(outDir, ".fetch-")
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), resp.Body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	actual := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	if actual != digest {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("digest mismatch: expected %s, got %s", digest, actual)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+func fetchBlobStream(c *registryClient, name, digest string) (*http.Response, error) {
+	resp, err := c.get(fmt.Sprintf("/v2/%s/blobs/%s", name, digest), "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+// selectPlatform picks the manifest digest matching platform out of a
+// manifest list's raw body. Without --platform only a list with a single
+// entry is accepted (that entry is returned); a longer list is an error,
+// since there's no local daemon to fall back on for an implicit "whatever
+// this host is" default.
+func selectPlatform(listBody []byte, platform *platformSpec) (string, error) {
+	var list struct {
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				Architecture string `json:"architecture"`
+				OS           string `json:"os"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(listBody, &list); err != nil {
+		return "", fmt.Errorf("decoding manifest list: %s", err)
+	}
+	if platform == nil {
+		if len(list.Manifests) == 1 {
+			return list.Manifests[0].Digest, nil
+		}
+		return "", fmt.Errorf("reference resolved to a manifest list with %d platforms; pass --platform os/arch[/variant] to pick one", len(list.Manifests))
+	}
+	for _, m := range list.Manifests {
+		if m.Platform.Architecture == platform.Arch && m.Platform.OS == platform.OS &&
+			(platform.Variant == "" || m.Platform.Variant == platform.Variant) {
+			return m.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("manifest list has no entry for platform %s", platform)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// imageReference is a parsed LAYER argument following the docker/reference
+// grammar: name[:tag][@digest]. Both a tag and a digest may be present at
+// once (e.g. "myimage:latest@sha256:...") to pin a tag to a specific
+// digest; parseReference itself doesn't check the two agree, that happens
+// once the image has actually been inspected.
+type imageReference struct {
+	Name   string
+	Tag    string
+	Digest string
+}
+
+var digestRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+
+// parseReference splits a LAYER argument into its repository, tag and
+// digest parts. A bare id or name with neither a tag nor a digest parses
+// fine too, with Name set to the whole string, same as before this
+// existed.
+func parseReference(s string) (*imageReference, error) {
+	ref := &imageReference{}
+
+	if at := strings.LastIndex(s, "@"); at != -1 {
+		digest := s[at+1:]
+		if !digestRe.MatchString(digest) {
+			return nil, fmt.Errorf("invalid digest %q in reference %q", digest, s)
+		}
+		ref.Digest = digest
+		s = s[:at]
+	}
+
+	// A colon after the last "/" is a tag; a colon before it is part of a
+	// host:port in the repository name, same rule docker/reference uses.
+	if colon := strings.LastIndex(s, ":"); colon != -1 && !strings.Contains(s[colon:], "/") {
+		ref.Tag = s[colon+1:]
+		s = s[:colon]
+	}
+
+	if s == "" {
+		return nil, fmt.Errorf("reference %q has no repository name", s)
+	}
+	ref.Name = s
+	return ref, nil
+}
+
+// Lookup returns the string to hand to InspectImage. A digest alone isn't
+// something a local daemon indexes images by, so the tag is preferred
+// when both are present; agreement between the two is checked separately
+// once the image is inspected.
+func (r *imageReference) Lookup() string {
+	if r.Tag != "" {
+		return r.Name + ":" + r.Tag
+	}
+	if r.Digest != "" {
+		return r.Name + "@" + r.Digest
+	}
+	return r.Name
+}
+
+// hasRepoDigest reports whether digests (as returned on docker.Image's
+// RepoDigests field) contains name@digest.
+func hasRepoDigest(digests []string, name, digest string) bool {
+	want := name + "@" + digest
+	for _, d := range digests {
+		if d == want {
+			return true
+		}
+	}
+	return false
+}
+
+// repoDigestFor returns the digest portion of the first RepoDigests entry
+// belonging to name, if any.
+func repoDigestFor(digests []string, name string) string {
+	prefix := name + "@"
+	for _, d := range digests {
+		if strings.HasPrefix(d, prefix) {
+			return strings.TrimPrefix(d, prefix)
+		}
+	}
+	return ""
+}
+
+// platformSpec is a parsed --platform flag: os/arch[/variant].
+type platformSpec struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+func parsePlatform(s string) (*platformSpec, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid --platform %q, expected os/arch[/variant]", s)
+	}
+	p := &platformSpec{OS: parts[0], Arch: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p *platformSpec) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Arch + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Arch
+}
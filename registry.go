@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// shimHandler implements just enough of the docker registry HTTP API for a
+// local daemon to push a tagged image into it, so dlgrab can capture the
+// layer(s) as they fly by. v1 is always served since that's what older
+// daemons fall back to for `docker push` against an unknown registry; v2
+// is served alongside it when enabled so newer daemons that prefer
+// v2/schema2 can be captured too. Everything it captures is written
+// through a layerSink, shared with the --from-registry pull path.
+type shimHandler struct {
+	sink *layerSink
+	v2   bool
+
+	uploadSeq int64
+	uploadsMu sync.Mutex
+	uploads   map[string]*os.File
+}
+
+// NewHandler returns an http.Handler speaking the registry protocol(s)
+// dlgrab needs in order to intercept a docker push. outDir is the
+// directory layers get written under; regFormat controls whether the
+// per-layer directories (json/layer.tar) also get the VERSION marker a
+// docker-save-style export has; the directory layout is otherwise the
+// same. v2 additionally serves
+// the /v2/ endpoint set so modern daemons can push schema2 manifests.
+// allLayers makes the v1 path persist every layer id the daemon pushes
+// instead of only the top one named by the global layerId. ociLayout
+// makes the v1 path content-address each layer blob by its sha256 digest
+// under blobs/sha256 instead of naming it by layer id, for --oci-layout.
+func NewHandler(outDir string, regFormat bool, v2 bool, allLayers bool, ociLayout bool) *shimHandler {
+	return &shimHandler{
+		sink:    newLayerSink(outDir, regFormat, allLayers, ociLayout),
+		v2:      v2,
+		uploads: make(map[string]*os.File),
+	}
+}
+
+var (
+	v1ImageJsonRe  = regexp.MustCompile(`^/v1/images/([^/]+)/json$`)
+	v1ImageLayerRe = regexp.MustCompile(`^/v1/images/([^/]+)/layer$`)
+	v1ImageSumRe   = regexp.MustCompile(`^/v1/images/([^/]+)/checksum$`)
+	v1RepoTagRe    = regexp.MustCompile(`^/v1/repositories/(.+)/tags/([^/]+)$`)
+	v1RepoRe       = regexp.MustCompile(`^/v1/repositories/(.+)/$`)
+	v1RepoImagesRe = regexp.MustCompile(`^/v1/repositories/(.+)/images$`)
+
+	v2BaseRe     = regexp.MustCompile(`^/v2/$`)
+	v2UploadsRe  = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/$`)
+	v2UploadRe   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([^/]+)$`)
+	v2BlobRe     = regexp.MustCompile(`^/v2/(.+)/blobs/(sha256:[0-9a-f]+)$`)
+	v2ManifestRe = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+)
+
+func (h *shimHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Debug("shim: %s %s", r.Method, r.URL.Path)
+
+	switch {
+	case r.URL.Path == "/v1/_ping":
+		w.Header().Set("X-Docker-Registry-Version", "0.6.3")
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case r.Method == "PUT" && v1RepoRe.MatchString(r.URL.Path):
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Docker-Token", "dlgrab-shim-token")
+		w.Header().Set("X-Docker-Endpoints", r.Host)
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case r.Method == "PUT" && v1ImageJsonRe.MatchString(r.URL.Path):
+		h.handleV1ImageJson(w, r, v1ImageJsonRe.FindStringSubmatch(r.URL.Path)[1])
+		return
+
+	case r.Method == "PUT" && v1ImageLayerRe.MatchString(r.URL.Path):
+		h.handleV1ImageLayer(w, r, v1ImageLayerRe.FindStringSubmatch(r.URL.Path)[1])
+		return
+
+	case r.Method == "PUT" && v1ImageSumRe.MatchString(r.URL.Path):
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case r.Method == "PUT" && v1RepoTagRe.MatchString(r.URL.Path):
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case r.Method == "PUT" && v1RepoImagesRe.MatchString(r.URL.Path):
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if h.v2 {
+		switch {
+		case r.Method == "GET" && v2BaseRe.MatchString(r.URL.Path):
+			w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+			w.Write([]byte("{}"))
+			return
+
+		case r.Method == "POST" && v2UploadsRe.MatchString(r.URL.Path):
+			h.handleV2StartUpload(w, r, v2UploadsRe.FindStringSubmatch(r.URL.Path)[1])
+			return
+
+		case r.Method == "PATCH" && v2UploadRe.MatchString(r.URL.Path):
+			m := v2UploadRe.FindStringSubmatch(r.URL.Path)
+			h.handleV2PatchUpload(w, r, m[1], m[2])
+			return
+
+		case r.Method == "PUT" && v2UploadRe.MatchString(r.URL.Path):
+			m := v2UploadRe.FindStringSubmatch(r.URL.Path)
+			h.handleV2FinishUpload(w, r, m[1], m[2])
+			return
+
+		case r.Method == "HEAD" && v2BlobRe.MatchString(r.URL.Path):
+			m := v2BlobRe.FindStringSubmatch(r.URL.Path)
+			h.handleV2HeadBlob(w, r, m[2])
+			return
+
+		case r.Method == "PUT" && v2ManifestRe.MatchString(r.URL.Path):
+			m := v2ManifestRe.FindStringSubmatch(r.URL.Path)
+			h.handleV2PutManifest(w, r, m[1], m[2])
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+// -- v1 --------------------------------------------------------------------
+
+func (h *shimHandler) handleV1ImageJson(w http.ResponseWriter, r *http.Request, imgId string) {
+	if err := h.sink.WriteConfig(imgId, r.Body); err != nil {
+		logger.Error("shim: writing config for %s: %s", imgId, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *shimHandler) handleV1ImageLayer(w http.ResponseWriter, r *http.Request, imgId string) {
+	if err := h.sink.WriteLayer(imgId, r.Body); err != nil {
+		logger.Error("shim: writing layer for %s: %s", imgId, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// -- v2 ----------------------------------------------------------------------
+
+// handleV2StartUpload begins a chunked blob upload, handing back a
+// Location the daemon will PATCH/PUT against. The upload uuid doubles as
+// the name of a scratch file under outDir/.uploads.
+func (h *shimHandler) handleV2StartUpload(w http.ResponseWriter, r *http.Request, name string) {
+	uploadDir := filepath.Join(h.sink.outDir, ".uploads")
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	uuid := fmt.Sprintf("upload-%d", atomic.AddInt64(&h.uploadSeq, 1))
+	f, err := os.Create(filepath.Join(uploadDir, uuid))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.uploadsMu.Lock()
+	h.uploads[uuid] = f
+	h.uploadsMu.Unlock()
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, uuid))
+	w.Header().Set("Range", "0-0")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *shimHandler) handleV2PatchUpload(w http.ResponseWriter, r *http.Request, name, uuid string) {
+	h.uploadsMu.Lock()
+	f := h.uploads[uuid]
+	h.uploadsMu.Unlock()
+	if f == nil {
+		http.NotFound(w, r)
+		return
+	}
+	n, err := io.Copy(f, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", n-1))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleV2FinishUpload copies any trailing bytes of the PUT body, hashing
+// the scratch file's full contents (not just this last chunk) as it goes,
+// then moves it into blobs/sha256/<digest>. When the client asserted a
+// digest, the move happens only once the computed digest is confirmed to
+// match it; a PUT with no digest parameter is committed under the computed
+// digest unchecked.
+func (h *shimHandler) handleV2FinishUpload(w http.ResponseWriter, r *http.Request, name, uuid string) {
+	h.uploadsMu.Lock()
+	f := h.uploads[uuid]
+	delete(h.uploads, uuid)
+	h.uploadsMu.Unlock()
+	if f == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	asserted := r.URL.Query().Get("digest")
+
+	hasher := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(hasher, f); err != nil {
+		f.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(io.MultiWriter(f, hasher), r.Body); err != nil {
+		f.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	actual := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	if asserted != "" && actual != asserted {
+		os.Remove(f.Name())
+		logger.Error("shim: blob digest mismatch, asserted %s got %s", asserted, actual)
+		http.Error(w, fmt.Sprintf("digest mismatch: asserted %s, computed %s", asserted, actual), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.sink.commitBlob(f.Name(), actual); err != nil {
+		logger.Error("shim: committing blob %s: %s", actual, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", actual)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *shimHandler) handleV2HeadBlob(w http.ResponseWriter, r *http.Request, digest string) {
+	if _, err := os.Stat(h.sink.blobPath(digest)); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *shimHandler) handleV2PutManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if err := ioutil.WriteFile(h.sink.blobPath(digest), body, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	manifestDir := filepath.Join(h.sink.outDir, "manifests")
+	if err := os.MkdirAll(manifestDir, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(manifestDir, ref+".json"), body, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// --all-layers/--oci-layout need to know which committed blobs are
+	// which layer in the image, something v2's blob-upload handlers never
+	// learn on their own (see CaptureV2Manifest); do that now that the
+	// manifest naming them has arrived, failing the push rather than
+	// completing it over a bundle we know came out wrong.
+	if h.sink.allLayers || h.sink.ociLayout {
+		if _, err := h.sink.CaptureV2Manifest(body); err != nil {
+			logger.Error("shim: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}
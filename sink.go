@@ -0,0 +1,341 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// layerSink is where a captured image's bytes end up on disk, independent
+// of how they got there. The push-intercepting shim (registry.go) and the
+// registry-pull client (pull.go) both write into one, so the on-disk
+// layout is identical whether dlgrab went through a docker daemon or
+// talked to a registry directly.
+type layerSink struct {
+	outDir    string
+	regFormat bool
+	allLayers bool
+	ociLayout bool
+
+	blobsMu    sync.Mutex
+	layerBlobs map[string]ociBlobInfo
+
+	capturedMu    sync.Mutex
+	capturedChain []string
+}
+
+// ociBlobInfo records where a content-addressed blob the sink has already
+// written ended up, so a later pass (see oci.go) can reference it by
+// digest when assembling an OCI manifest. DiffID is the digest of the
+// layer's *uncompressed* tar content, which is what OCI rootfs.diff_ids
+// actually wants - distinct from Digest, the compressed blob's own
+// identity on disk.
+type ociBlobInfo struct {
+	Digest string
+	Size   int64
+	DiffID string
+}
+
+func newLayerSink(outDir string, regFormat, allLayers, ociLayout bool) *layerSink {
+	return &layerSink{
+		outDir:     outDir,
+		regFormat:  regFormat,
+		allLayers:  allLayers,
+		ociLayout:  ociLayout,
+		layerBlobs: make(map[string]ociBlobInfo),
+	}
+}
+
+// ensureLayerDir returns the directory a layer's json/layer.tar should
+// land in, creating it (and its VERSION marker) on first use. It returns
+// "" for layers dlgrab isn't interested in: unless allLayers is set, only
+// the top layer (the global layerId) is kept, matching the single-layer
+// export dlgrab has always done.
+func (s *layerSink) ensureLayerDir(imgId string) (string, error) {
+	layerLock.Lock()
+	top := layerId
+	layerLock.Unlock()
+	if !s.allLayers && imgId != top {
+		return "", nil
+	}
+
+	dir := filepath.Join(s.outDir, imgId)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if !s.regFormat {
+		versionPath := filepath.Join(dir, "VERSION")
+		if _, err := os.Stat(versionPath); os.IsNotExist(err) {
+			if err := ioutil.WriteFile(versionPath, []byte("1.0"), 0644); err != nil {
+				return "", err
+			}
+		}
+	}
+	return dir, nil
+}
+
+// WriteConfig persists an image's json config under imgId's layer
+// directory. Under --oci-layout the config is rebuilt by writeOCILayout
+// (oci.go) once the whole image has been captured, from the fields its
+// caller supplies (InspectImage for the shim, the fetched config blob for
+// --from-registry), so here it's just drained.
+func (s *layerSink) WriteConfig(imgId string, r io.Reader) error {
+	if s.ociLayout {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	dir, err := s.ensureLayerDir(imgId)
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "json"), body, 0644)
+}
+
+// WriteLayer persists a layer's tar stream, either under imgId's layer
+// directory or, under --oci-layout, as a content-addressed blob keyed by
+// its own sha256 digest.
+func (s *layerSink) WriteLayer(imgId string, r io.Reader) error {
+	if s.ociLayout {
+		digest, size, err := s.writeContentAddressedBlob(r)
+		if err != nil {
+			return err
+		}
+		diffID, err := diffIDForBlob(s.blobPath(digest))
+		if err != nil {
+			return fmt.Errorf("computing diff id for layer %s: %s", digest, err)
+		}
+		s.blobsMu.Lock()
+		s.layerBlobs[imgId] = ociBlobInfo{Digest: digest, Size: size, DiffID: diffID}
+		s.blobsMu.Unlock()
+		return nil
+	}
+
+	dir, err := s.ensureLayerDir(imgId)
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, "layer.tar"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// LayerBlob returns where a layer blob the sink has already written ended
+// up on disk, for a --oci-layout export to reference by digest.
+func (s *layerSink) LayerBlob(imgId string) (ociBlobInfo, bool) {
+	s.blobsMu.Lock()
+	defer s.blobsMu.Unlock()
+	info, ok := s.layerBlobs[imgId]
+	return info, ok
+}
+
+// writeContentAddressedBlob streams r to a scratch file while hashing it,
+// then moves the result into blobs/sha256/<digest>, computing and
+// verifying the digest as it goes rather than trusting a name supplied by
+// whoever handed us r.
+func (s *layerSink) writeContentAddressedBlob(r io.Reader) (digest string, size int64, err error) {
+	if err := os.MkdirAll(s.outDir, 0755); err != nil {
+		return "", 0, err
+	}
+	tmp, err := ioutil.TempFile(s.outDir, ".blob-")
+	if err != nil {
+		return "", 0, err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	digest = "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	if err := s.commitBlob(tmpPath, digest); err != nil {
+		return "", 0, err
+	}
+	return digest, n, nil
+}
+
+// blobPath returns the on-disk location for a blob, laid out the same way
+// `distribution` (and OCI tooling generally) expects: blobs/<algo>/<hex>.
+func (s *layerSink) blobPath(digest string) string {
+	algo, hexSum := splitDigest(digest)
+	return filepath.Join(s.outDir, "blobs", algo, hexSum)
+}
+
+// commitBlob moves a scratch file into blobs/<algo>/<hex> for an
+// already-known digest, used when the caller (e.g. a v2 push, which
+// names its upload by digest) supplies the digest itself.
+func (s *layerSink) commitBlob(tmpPath, digest string) error {
+	algo, hexSum := splitDigest(digest)
+	dir := filepath.Join(s.outDir, "blobs", algo)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, hexSum))
+}
+
+func splitDigest(digest string) (algo, hexSum string) {
+	for i := 0; i < len(digest); i++ {
+		if digest[i] == ':' {
+			return digest[:i], digest[i+1:]
+		}
+	}
+	return "sha256", digest
+}
+
+// CaptureV2Manifest finalizes a manifest the v2 shim just received. Unlike
+// the v1 protocol, v2 never tells the shim which docker layer id a blob
+// upload belongs to as it streams by (only a digest) - layer identity for
+// a v2 capture is only knowable once the manifest itself arrives, listing
+// each layer by digest. By the time this runs every blob it names is
+// already sitting in blobs/sha256, committed by the upload handlers; this
+// decides what to do with them now that their place in the image is
+// known, so --all-layers and --oci-layout work the same whether an image
+// came in over v1 or v2. It returns the layer chain it derived, newest
+// first like ImageHistory, for the caller to use in place of the
+// docker-daemon-derived one.
+func (s *layerSink) CaptureV2Manifest(manifestBody []byte) ([]string, error) {
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBody, &manifest); err != nil {
+		return nil, fmt.Errorf("decoding pushed manifest: %s", err)
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, fmt.Errorf("pushed manifest has no layers")
+	}
+
+	chain := make([]string, len(manifest.Layers))
+	for i, l := range manifest.Layers {
+		chain[len(manifest.Layers)-1-i] = strings.Replace(l.Digest, ":", "_", 1)
+	}
+	topId := chain[0]
+
+	if s.ociLayout {
+		for i, l := range manifest.Layers {
+			synthId := chain[len(manifest.Layers)-1-i]
+			diffID, err := diffIDForBlob(s.blobPath(l.Digest))
+			if err != nil {
+				return nil, fmt.Errorf("computing diff id for layer %s: %s", l.Digest, err)
+			}
+			s.blobsMu.Lock()
+			s.layerBlobs[synthId] = ociBlobInfo{Digest: l.Digest, Size: l.Size, DiffID: diffID}
+			s.blobsMu.Unlock()
+		}
+	} else {
+		// Materialize the legacy per-layer directories writeImageBundle
+		// expects, the same shape ensureLayerDir produces for a v1 push,
+		// copying bytes out of the content-addressed blobs rather than
+		// streaming them fresh since they're already on disk.
+		layerLock.Lock()
+		layerId = topId
+		layerLock.Unlock()
+
+		for i, l := range manifest.Layers {
+			synthId := chain[len(manifest.Layers)-1-i]
+			if !s.allLayers && synthId != topId {
+				continue
+			}
+			dir, err := s.ensureLayerDir(synthId)
+			if err != nil {
+				return nil, err
+			}
+			if dir == "" {
+				continue
+			}
+			if err := copyFile(s.blobPath(l.Digest), filepath.Join(dir, "layer.tar")); err != nil {
+				return nil, fmt.Errorf("copying layer blob %s: %s", l.Digest, err)
+			}
+		}
+
+		topDir, err := s.ensureLayerDir(topId)
+		if err != nil {
+			return nil, err
+		}
+		if topDir != "" {
+			if err := copyFile(s.blobPath(manifest.Config.Digest), filepath.Join(topDir, "json")); err != nil {
+				return nil, fmt.Errorf("copying config blob %s: %s", manifest.Config.Digest, err)
+			}
+		}
+	}
+
+	s.capturedMu.Lock()
+	s.capturedChain = chain
+	s.capturedMu.Unlock()
+	return chain, nil
+}
+
+// CapturedChain returns the layer chain the most recent CaptureV2Manifest
+// call derived, or nil if none has run.
+func (s *layerSink) CapturedChain() []string {
+	s.capturedMu.Lock()
+	defer s.capturedMu.Unlock()
+	return s.capturedChain
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// diffIDForBlob computes the OCI rootfs diff_id for an on-disk gzip layer
+// blob: the sha256 digest of its *uncompressed* tar content
+// (image-spec/config.md#properties), as distinct from the compressed
+// blob's own digest, which is what the blob is named and addressed by on
+// disk.
+func diffIDForBlob(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, gz); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}